@@ -6,6 +6,8 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/containerd/containerd"
@@ -13,16 +15,28 @@ import (
 	"github.com/containerd/containerd/api/services/execution"
 	"github.com/containerd/containerd/api/types/task"
 	dockermount "github.com/docker/docker/pkg/mount"
+	"github.com/docker/docker/pkg/signal"
 	"github.com/docker/swarmkit/agent/exec"
 	"github.com/docker/swarmkit/api"
 	"github.com/docker/swarmkit/api/naming"
 	"github.com/docker/swarmkit/log"
+	gogotypes "github.com/gogo/protobuf/types"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 )
 
+// stateDir is the root under which the adapter keeps per-task scratch
+// state that isn't managed by containerd itself, such as staged secret and
+// config files.
+const stateDir = "/var/lib/containerd/swarmkit"
+
+// defaultStopGracePeriod is how long terminate() waits for a task to exit
+// after its stop signal before escalating to escalationSignal, when the
+// task spec doesn't specify a StopGracePeriod.
+const defaultStopGracePeriod = 10 * time.Second
+
 var (
 	devNull                    *os.File
 	errAdapterNotPrepared      = errors.New("container adapter not prepared")
@@ -40,41 +54,54 @@ var (
 // are mostly naked calls to the client API, seeded with information from
 // containerConfig.
 type containerAdapter struct {
-	client         *containerd.Client
-	spec           *api.ContainerSpec
-	secrets        exec.SecretGetter
-	name           string
-	image          containerd.Image // Pulled image
-	container      containerd.Container
-	task           containerd.Task
-	deleteResponse *execution.DeleteResponse
+	client           *containerd.Client
+	spec             *api.ContainerSpec
+	apiTask          *api.Task
+	secrets          exec.SecretGetter
+	configs          exec.ConfigGetter
+	dispatcher       *eventDispatcher
+	name             string
+	image            containerd.Image // Pulled image
+	container        containerd.Container
+	task             containerd.Task
+	deleteResponse   *execution.DeleteResponse
+	stopGracePeriod  time.Duration
+	escalationSignal syscall.Signal
+	logs             *logBroadcaster
 }
 
-func newContainerAdapter(client *containerd.Client, task *api.Task, secrets exec.SecretGetter) (*containerAdapter, error) {
+// newContainerAdapter constructs an adapter for task. stopGracePeriod and
+// escalationSignal override terminate()'s default SIGTERM/10s/SIGKILL
+// behavior; passing zero values for either applies the defaults, which is
+// what production callers do. Tests that need a deterministic, fast
+// terminate() path can override both directly.
+func newContainerAdapter(client *containerd.Client, task *api.Task, secrets exec.SecretGetter, configs exec.ConfigGetter, dispatcher *eventDispatcher, stopGracePeriod time.Duration, escalationSignal syscall.Signal) (*containerAdapter, error) {
 	spec := task.Spec.GetContainer()
 	if spec == nil {
 		return nil, exec.ErrRuntimeUnsupported
 	}
 
 	return &containerAdapter{
-		client:  client,
-		spec:    spec,
-		secrets: secrets,
-		name:    naming.Task(task),
+		client:           client,
+		spec:             spec,
+		apiTask:          task,
+		secrets:          secrets,
+		configs:          configs,
+		dispatcher:       dispatcher,
+		stopGracePeriod:  stopGracePeriod,
+		escalationSignal: escalationSignal,
+		name:             naming.Task(task),
 	}, nil
 }
 
-func (c *containerAdapter) pullImage(ctx context.Context) error {
-	image, err := c.client.Pull(ctx, c.spec.Image, containerd.WithPullUnpack)
-	if err != nil {
-		return errors.Wrap(err, "pulling container image")
-	}
-	c.image = image
-
-	return nil
+// taskStateDir is where the adapter stages per-task files that live outside
+// of anything containerd tracks for us, e.g. secret/config material bind
+// mounted into the container.
+func (c *containerAdapter) taskStateDir() string {
+	return filepath.Join(stateDir, c.name)
 }
 
-func withMounts(ctx context.Context, ms []api.Mount) containerd.SpecOpts {
+func (c *containerAdapter) withMounts(ctx context.Context, ms []api.Mount) containerd.SpecOpts {
 	sort.Sort(mounts(ms))
 
 	return func(s *specs.Spec) error {
@@ -112,7 +139,26 @@ func withMounts(ctx context.Context, ms []api.Mount) containerd.SpecOpts {
 				})
 
 			case api.MountTypeVolume:
-				return errors.Errorf("volume mounts not implemented, ignoring %v", m)
+				volumeMounts, err := c.prepareVolume(ctx, m)
+				if err != nil {
+					return errors.Wrapf(err, "preparing volume mount %s", m.Target)
+				}
+
+				for _, vm := range volumeMounts {
+					opts := append([]string{}, vm.Options...)
+					if m.ReadOnly {
+						opts = append(opts, "ro")
+					} else {
+						opts = append(opts, "rw")
+					}
+
+					s.Mounts = append(s.Mounts, specs.Mount{
+						Destination: m.Target,
+						Type:        vm.Type,
+						Source:      vm.Source,
+						Options:     opts,
+					})
+				}
 
 			case api.MountTypeBind:
 				opts := []string{"rbind"}
@@ -160,9 +206,16 @@ func (c *containerAdapter) prepare(ctx context.Context) error {
 		"ID": c.name,
 	})
 
+	withSecretsAndConfigs, err := c.withSecretsAndConfigs(ctx)
+	if err != nil {
+		return errors.Wrap(err, "staging secrets and configs")
+	}
+
 	specOpts := []containerd.SpecOpts{
 		containerd.WithImageConfig(ctx, c.image),
-		withMounts(ctx, c.spec.Mounts),
+		c.withMounts(ctx, c.spec.Mounts),
+		withSecretsAndConfigs,
+		c.withResources(c.apiTask),
 	}
 
 	// spec.Process.Args is config.Entrypoint + config.Cmd at this
@@ -186,14 +239,6 @@ func (c *containerAdapter) prepare(ctx context.Context) error {
 		return err
 	}
 
-	// TODO(ijc) Consider an addition to container library which
-	// directly attaches stdin to /dev/null.
-	if devNull == nil {
-		if devNull, err = os.Open(os.DevNull); err != nil {
-			return errors.Wrap(err, "opening null device")
-		}
-	}
-
 	c.container, err = c.client.NewContainer(ctx, c.name,
 		containerd.WithSpec(spec),
 		containerd.WithNewRootFS(c.name, c.image))
@@ -201,8 +246,14 @@ func (c *containerAdapter) prepare(ctx context.Context) error {
 		return errors.Wrap(err, "creating container")
 	}
 
-	// TODO(ijc) support ControllerLogs interface.
-	io := containerd.NewIOWithTerminal(devNull, os.Stdout, os.Stderr, spec.Process.Terminal)
+	io, err := c.withFIFOStdio(ctx, spec.Process.Terminal)
+	if err != nil {
+		if err2 := c.container.Delete(ctx); err2 != nil {
+			l.WithError(err2).Error("failed to delete container on prepare failure")
+		}
+		c.container = nil
+		return errors.Wrap(err, "setting up container stdio")
+	}
 
 	c.task, err = c.container.NewTask(ctx, io)
 	if err != nil {
@@ -231,21 +282,14 @@ func (c *containerAdapter) start(ctx context.Context) error {
 	return err
 }
 
-func (c *containerAdapter) eventStream(ctx context.Context, id string) (<-chan task.Event, <-chan error, error) {
-
-	var (
-		evtch = make(chan task.Event)
-		errch = make(chan error)
-	)
-
-	return evtch, errch, nil
-}
-
-// events issues a call to the events API and returns a channel with all
-// events. The stream of events can be shutdown by cancelling the context.
+// events returns a channel with every event for this container, sourced
+// from the executor's single shared eventDispatcher rather than opening a
+// dedicated events stream per container. The stream of events can be
+// shutdown by cancelling the context.
 //
-// A chan struct{} is returned that will be closed if the event processing
-// fails and needs to be restarted.
+// A chan struct{} is returned that will be closed once the subscription is
+// torn down after ctx is cancelled. An adapter that isn't prepared returns
+// errAdapterNotPrepared and nil channels instead.
 func (c *containerAdapter) events(ctx context.Context, opts ...grpc.CallOption) (<-chan task.Event, <-chan struct{}, error) {
 	if !c.isPrepared() {
 		return nil, nil, errAdapterNotPrepared
@@ -254,43 +298,15 @@ func (c *containerAdapter) events(ctx context.Context, opts ...grpc.CallOption)
 	l := log.G(ctx).WithFields(logrus.Fields{
 		"ID": c.name,
 	})
-
-	// TODO(stevvooe): Move this to a single, global event dispatch. For
-	// now, we create a connection per container.
-	var (
-		eventsq = make(chan task.Event)
-		closed  = make(chan struct{})
-	)
-
 	l.Debugf("waiting on events")
 
-	tasks := c.client.TaskService()
-	cl, err := tasks.Events(ctx, &execution.EventsRequest{}, opts...)
-	if err != nil {
-		l.WithError(err).Errorf("failed to start event stream")
-		return nil, nil, err
-	}
+	eventsq, unsubscribe := c.dispatcher.Subscribe(c.name)
+	closed := make(chan struct{})
 
 	go func() {
 		defer close(closed)
-
-		for {
-			evt, err := cl.Recv()
-			if err != nil {
-				l.WithError(err).Error("fatal error from events stream")
-				return
-			}
-			if evt.ID != c.name {
-				l.Debugf("Event for a different container %s", evt.ID)
-				continue
-			}
-
-			select {
-			case eventsq <- *evt:
-			case <-ctx.Done():
-				return
-			}
-		}
+		<-ctx.Done()
+		unsubscribe()
 	}()
 
 	return eventsq, closed, nil
@@ -319,7 +335,8 @@ func (c *containerAdapter) shutdown(ctx context.Context) (uint32, error) {
 	})
 
 	if c.deleteResponse == nil {
-		var err error
+		// terminate() hasn't already stopped this task, so stop and reap
+		// it now via a hard delete.
 		l.Debug("Deleting")
 
 		tasks := c.client.TaskService()
@@ -337,11 +354,51 @@ func (c *containerAdapter) shutdown(ctx context.Context) (uint32, error) {
 		if err != nil {
 			l.WithError(err).Warnf("failed to delete container")
 		}
+
+		c.releaseVolumes(ctx, l)
+
+		if err := c.wipeSecretsAndConfigs(); err != nil {
+			l.WithError(err).Warnf("failed to wipe staged secrets and configs")
+		}
+	} else {
+		// terminate() already stopped the task and captured its exit status,
+		// but the task object itself (and the shim process backing it) is
+		// still around until TaskService.Delete reaps it; Kill/Wait alone
+		// don't do that.
+		tasks := c.client.TaskService()
+		if _, err := tasks.Delete(ctx, &execution.DeleteRequest{ContainerID: c.name}); err != nil {
+			l.WithError(err).Warnf("failed to delete task")
+		}
+
+		containers := c.client.ContainerService()
+		if _, err := containers.Delete(ctx, &containersapi.DeleteContainerRequest{ID: c.name}); err != nil {
+			l.WithError(err).Warnf("failed to delete container")
+		}
+
+		c.releaseVolumes(ctx, l)
+
+		if err := c.wipeSecretsAndConfigs(); err != nil {
+			l.WithError(err).Warnf("failed to wipe staged secrets and configs")
+		}
 	}
 
 	return c.deleteResponse.ExitStatus, nil
 }
 
+// releaseVolumes calls releaseVolume for every volume mount, which leaves
+// the snapshot in place rather than deleting it, since a named volume is expected to survive the task that used it;
+// pruneVolumes is what eventually reclaims one that's no longer referenced.
+func (c *containerAdapter) releaseVolumes(ctx context.Context, l *logrus.Entry) {
+	for _, m := range c.spec.Mounts {
+		if m.Type != api.MountTypeVolume {
+			continue
+		}
+		if err := c.releaseVolume(ctx, m); err != nil {
+			l.WithError(err).Warnf("failed to release volume mount %s", m.Target)
+		}
+	}
+}
+
 func (c *containerAdapter) terminate(ctx context.Context) error {
 	if !c.isPrepared() {
 		return errAdapterNotPrepared
@@ -351,7 +408,59 @@ func (c *containerAdapter) terminate(ctx context.Context) error {
 		"ID": c.name,
 	})
 	l.Debug("Terminate")
-	return errors.New("terminate not implemented")
+
+	sig, err := signal.ParseSignal(c.spec.StopSignal)
+	if err != nil {
+		sig = syscall.SIGTERM
+	}
+
+	grace := c.stopGracePeriod
+	if grace <= 0 && c.spec.StopGracePeriod != nil {
+		if d, err := gogotypes.DurationFromProto(c.spec.StopGracePeriod); err == nil && d > 0 {
+			grace = d
+		}
+	}
+	if grace <= 0 {
+		grace = defaultStopGracePeriod
+	}
+
+	if err := c.task.Kill(ctx, sig); err != nil {
+		return errors.Wrap(err, "sending stop signal")
+	}
+
+	status, err := c.waitWithGracePeriod(ctx, grace)
+	if err != nil {
+		return errors.Wrap(err, "waiting for task to stop")
+	}
+
+	c.deleteResponse = &execution.DeleteResponse{ExitStatus: status}
+	return nil
+}
+
+// waitWithGracePeriod waits up to grace for the task to exit after it was
+// sent its stop signal, escalating to c.escalationSignal (SIGKILL by
+// default) if the grace period elapses before it does.
+func (c *containerAdapter) waitWithGracePeriod(ctx context.Context, grace time.Duration) (uint32, error) {
+	graceCtx, cancel := context.WithTimeout(ctx, grace)
+	defer cancel()
+
+	status, err := c.task.Wait(graceCtx)
+	if err == nil {
+		return status, nil
+	}
+	if graceCtx.Err() != context.DeadlineExceeded {
+		return 0, err
+	}
+
+	escalation := c.escalationSignal
+	if escalation == 0 {
+		escalation = syscall.SIGKILL
+	}
+
+	if err := c.task.Kill(ctx, escalation); err != nil {
+		return 0, errors.Wrap(err, "escalating stop signal")
+	}
+	return c.task.Wait(ctx)
 }
 
 func (c *containerAdapter) remove(ctx context.Context) error {
@@ -363,6 +472,9 @@ func (c *containerAdapter) remove(ctx context.Context) error {
 		"ID": c.name,
 	})
 	l.Debug("Remove")
+	if err := c.wipeSecretsAndConfigs(); err != nil {
+		l.WithError(err).Warnf("failed to wipe staged secrets and configs")
+	}
 	return nil
 }
 
@@ -399,4 +511,4 @@ func (m mounts) Swap(i, j int) {
 // parts returns the number of parts in the destination of a mount. Used in sorting.
 func (m mounts) parts(i int) int {
 	return strings.Count(filepath.Clean(m[i].Target), string(os.PathSeparator))
-}
\ No newline at end of file
+}
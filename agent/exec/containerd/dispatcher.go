@@ -0,0 +1,167 @@
+package containerd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/api/services/execution"
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/docker/swarmkit/log"
+	"golang.org/x/net/context"
+)
+
+// eventReplayBufferSize is how many of a container's most recent events the
+// dispatcher replays to a late subscriber, so that a subscriber which
+// attaches only after prepare() still sees the exit event of a task that
+// died before the subscription was made.
+const eventReplayBufferSize = 10
+
+// eventDispatcher owns the single gRPC stream against containerd's task
+// Events API for the executor, demultiplexing by container ID into
+// per-container subscriptions. This replaces opening one events stream per
+// container, which doesn't scale to a node running many tasks.
+type eventDispatcher struct {
+	client *containerd.Client
+
+	mu     sync.Mutex
+	subs   map[string][]chan task.Event
+	ring   map[string][]task.Event
+	closed bool
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewEventDispatcher starts demultiplexing containerd task events in the
+// background. The executor owns the single instance of this and passes it
+// to each containerAdapter it creates, which calls Subscribe on it.
+func NewEventDispatcher(client *containerd.Client) *eventDispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	d := &eventDispatcher{
+		client: client,
+		subs:   make(map[string][]chan task.Event),
+		ring:   make(map[string][]task.Event),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go d.run(ctx)
+
+	return d
+}
+
+func (d *eventDispatcher) run(ctx context.Context) {
+	defer close(d.done)
+
+	backoff := time.Second
+	const maxBackoff = 30 * time.Second
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		tasks := d.client.TaskService()
+		cl, err := tasks.Events(ctx, &execution.EventsRequest{})
+		if err != nil {
+			log.G(ctx).WithError(err).Errorf("failed to open containerd events stream, retrying in %s", backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff < maxBackoff {
+				backoff *= 2
+			}
+			continue
+		}
+
+		backoff = time.Second
+
+		for {
+			evt, err := cl.Recv()
+			if err != nil {
+				log.G(ctx).WithError(err).Error("containerd events stream closed, reconnecting")
+				break
+			}
+			d.dispatch(*evt)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+}
+
+func (d *eventDispatcher) dispatch(evt task.Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ring := append(d.ring[evt.ID], evt)
+	if len(ring) > eventReplayBufferSize {
+		ring = ring[len(ring)-eventReplayBufferSize:]
+	}
+	d.ring[evt.ID] = ring
+
+	for _, ch := range d.subs[evt.ID] {
+		select {
+		case ch <- evt:
+		default:
+			log.G(context.Background()).Warnf("dropping event for %s, subscriber not keeping up", evt.ID)
+		}
+	}
+}
+
+// Subscribe registers interest in events for the container identified by
+// id. The returned channel is first fed any buffered events already seen
+// for id, then every new one as it arrives. The returned func must be
+// called to unregister and release the channel once the subscriber is
+// done.
+func (d *eventDispatcher) Subscribe(id string) (<-chan task.Event, func()) {
+	d.mu.Lock()
+	ch := make(chan task.Event, eventReplayBufferSize)
+	for _, evt := range d.ring[id] {
+		ch <- evt
+	}
+	d.subs[id] = append(d.subs[id], ch)
+	d.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			subs := d.subs[id]
+			for i, c := range subs {
+				if c == ch {
+					d.subs[id] = append(subs[:i], subs[i+1:]...)
+					break
+				}
+			}
+			close(ch)
+		})
+	}
+}
+
+// Close stops the dispatcher's event stream goroutine. It's driven from
+// the executor's shutdown path.
+func (d *eventDispatcher) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	d.mu.Unlock()
+
+	d.cancel()
+	<-d.done
+	return nil
+}
@@ -0,0 +1,238 @@
+package containerd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/docker/swarmkit/api"
+	"github.com/docker/swarmkit/log"
+	gogotypes "github.com/gogo/protobuf/types"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// logRingBufferLines bounds how many lines of output logBroadcaster keeps
+// in memory (and is willing to replay to a subscriber attaching after the
+// fact), counted across stdout and stderr together since both share one
+// ring.
+const logRingBufferLines = 1000
+
+// logBroadcaster owns a single task's captured stdio, fanning each line
+// out to subscribers registered through containerAdapter.Logs and
+// appending it to an on-disk log file. A subscriber that attaches later is
+// replayed only what is still in the in-memory ring; the file is never
+// read back or trimmed.
+type logBroadcaster struct {
+	mu       sync.Mutex
+	subs     []chan api.LogMessage
+	ring     []api.LogMessage
+	ringFile *os.File
+}
+
+func newLogBroadcaster(path string) (*logBroadcaster, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening log ring buffer file")
+	}
+	return &logBroadcaster{ringFile: f}, nil
+}
+
+func (b *logBroadcaster) publish(msg api.LogMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.ring = append(b.ring, msg)
+	if len(b.ring) > logRingBufferLines {
+		b.ring = b.ring[len(b.ring)-logRingBufferLines:]
+	}
+
+	fmt.Fprintf(b.ringFile, "%d\t%d\t%s\n", msg.Timestamp.GetSeconds(), msg.Stream, msg.Data)
+
+	for _, ch := range b.subs {
+		select {
+		case ch <- msg:
+		default:
+			// Subscriber isn't keeping up; drop rather than block the
+			// stdio reader goroutine.
+		}
+	}
+}
+
+// subscribe returns a channel fed with up to tail buffered lines (or all of
+// them if tail < 0), followed by every new line as it's published. The
+// returned func unregisters the subscription.
+func (b *logBroadcaster) subscribe(tail int) (<-chan api.LogMessage, func()) {
+	b.mu.Lock()
+	ch := make(chan api.LogMessage, logRingBufferLines)
+
+	start := 0
+	if tail >= 0 && tail < len(b.ring) {
+		start = len(b.ring) - tail
+	}
+	for _, msg := range b.ring[start:] {
+		ch <- msg
+	}
+
+	b.subs = append(b.subs, ch)
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			for i, c := range b.subs {
+				if c == ch {
+					b.subs = append(b.subs[:i], b.subs[i+1:]...)
+					break
+				}
+			}
+			close(ch)
+		})
+	}
+}
+
+func (b *logBroadcaster) Close() error {
+	return b.ringFile.Close()
+}
+
+// withFIFOStdio replaces the node-wide os.Stdout/os.Stderr redirection
+// that prepare() used to do with FIFO-backed stdio: a goroutine per stream
+// tails the FIFO and republishes each line through c.logs, so that
+// ControllerLogs subscribers see it instead of it landing on the node's
+// console.
+func (c *containerAdapter) withFIFOStdio(ctx context.Context, terminal bool) (containerd.IO, error) {
+	fifoDir := filepath.Join(c.taskStateDir(), "io")
+	if err := os.MkdirAll(fifoDir, 0700); err != nil {
+		return nil, errors.Wrap(err, "creating fifo dir")
+	}
+
+	logBuf, err := newLogBroadcaster(filepath.Join(c.taskStateDir(), "logs.ring"))
+	if err != nil {
+		return nil, err
+	}
+	c.logs = logBuf
+
+	stdout, err := c.streamFIFO(filepath.Join(fifoDir, "stdout"), api.LogStreamStdout)
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := c.streamFIFO(filepath.Join(fifoDir, "stderr"), api.LogStreamStderr)
+	if err != nil {
+		return nil, err
+	}
+
+	if devNull == nil {
+		var err error
+		if devNull, err = os.Open(os.DevNull); err != nil {
+			return nil, errors.Wrap(err, "opening null device")
+		}
+	}
+
+	return containerd.NewIOWithTerminal(devNull, stdout, stderr, terminal), nil
+}
+
+// streamFIFO creates a FIFO at path, returns the write end for containerd
+// to write the container's output into, and spawns a goroutine reading the
+// other end line by line, publishing each line to c.logs tagged with
+// stream. The reader end is opened O_NONBLOCK purely so the open() call
+// itself doesn't block waiting for the O_WRONLY open below to happen; once
+// both ends are open the read fd is switched back to blocking mode, since a
+// non-blocking fd behind a bufio.Scanner fails its Scan() on the first
+// EAGAIN instead of waiting for more data, which would silently kill the
+// reader goroutine with nothing logged.
+func (c *containerAdapter) streamFIFO(path string, stream api.LogStream) (*os.File, error) {
+	if err := syscall.Mkfifo(path, 0700); err != nil && !os.IsExist(err) {
+		return nil, errors.Wrapf(err, "creating fifo %s", path)
+	}
+
+	reader, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening read end of fifo %s", path)
+	}
+
+	writer, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		reader.Close()
+		return nil, errors.Wrapf(err, "opening write end of fifo %s", path)
+	}
+
+	if err := syscall.SetNonblock(int(reader.Fd()), false); err != nil {
+		reader.Close()
+		writer.Close()
+		return nil, errors.Wrapf(err, "clearing O_NONBLOCK on read end of fifo %s", path)
+	}
+
+	go func() {
+		defer reader.Close()
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			ts, err := gogotypes.TimestampProto(time.Now())
+			if err != nil {
+				continue
+			}
+			c.logs.publish(api.LogMessage{
+				Stream:    stream,
+				Timestamp: ts,
+				Data:      append([]byte(nil), scanner.Bytes()...),
+			})
+		}
+		if err := scanner.Err(); err != nil {
+			log.G(context.Background()).WithError(err).Errorf("log stream for %s stopped unexpectedly", path)
+		}
+	}()
+
+	return writer, nil
+}
+
+// Logs implements exec.ControllerLogs, streaming this task's stdio to the
+// caller honoring the Tail option from opts.
+//
+// TODO(ijc): honor opts.Options.Since by filtering against msg.Timestamp;
+// today tail is the only filter applied.
+func (c *containerAdapter) Logs(ctx context.Context, opts api.LogSubscriptionOptions) (<-chan api.LogMessage, error) {
+	if c.logs == nil {
+		return nil, errors.New("no log stream available for this task")
+	}
+
+	tail := -1
+	if opts.Tail > 0 {
+		tail = int(opts.Tail)
+	}
+
+	ch, unsubscribe := c.logs.subscribe(tail)
+	out := make(chan api.LogMessage)
+
+	go func() {
+		defer close(out)
+		defer unsubscribe()
+		for {
+			select {
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				select {
+				case out <- msg:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// TODO(ijc): this checkout doesn't have the controller type that wraps
+// containerAdapter and implements the exec.Controller interface, so Logs
+// can't be wired up to satisfy exec.ControllerLogs here. In the full repo,
+// controller.Logs should just delegate to containerAdapter.Logs above.
@@ -0,0 +1,130 @@
+package containerd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Pull policy values accepted by pullImage.
+//
+// TODO(ijc): api.PullOptions has no PullPolicy field yet, so there is no way
+// for a task to actually request anything but PullPolicyIfNotPresent today.
+// These constants (and the policy checks in pullImage below) are kept ready
+// for when the proto grows one, gated for now behind the hardcoded default.
+const (
+	PullPolicyAlways       = "always"
+	PullPolicyIfNotPresent = "if-not-present"
+	PullPolicyNever        = "never"
+)
+
+// PullProgress describes a single status update during an image pull, for
+// forwarding up to the manager the same way the docker executor surfaces
+// `docker service logs`-visible pull status.
+type PullProgress struct {
+	Image  string
+	Status string
+	Err    error
+}
+
+// authorizerFromRegistryAuth builds a docker remotes Authorizer out of the
+// base64-JSON RegistryAuth blob swarmkit carries on PullOptions, which is
+// the same blob the moby executor decodes into types.AuthConfig. A missing
+// or empty blob results in an anonymous authorizer.
+func authorizerFromRegistryAuth(encoded string) (docker.Authorizer, error) {
+	if encoded == "" {
+		return docker.NewAuthorizer(nil, nil), nil
+	}
+
+	buf, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding registry auth")
+	}
+
+	var auth types.AuthConfig
+	if err := json.Unmarshal(buf, &auth); err != nil {
+		return nil, errors.Wrap(err, "unmarshaling registry auth")
+	}
+
+	return docker.NewAuthorizer(nil, func(string) (string, string, error) {
+		if auth.IdentityToken != "" {
+			return "", auth.IdentityToken, nil
+		}
+		return auth.Username, auth.Password, nil
+	}), nil
+}
+
+// hasLocalImage reports whether an image with the adapter's spec's image
+// reference already exists in containerd's image store.
+func (c *containerAdapter) hasLocalImage(ctx context.Context) (bool, error) {
+	_, err := c.client.ImageService().Get(ctx, c.spec.Image)
+	if err == nil {
+		return true, nil
+	}
+	if errdefs.IsNotFound(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (c *containerAdapter) pullImage(ctx context.Context, progress chan<- PullProgress) error {
+	// api.PullOptions carries no PullPolicy field today, so there's nothing
+	// on the task to read one off of; every task behaves as PullPolicyIfNotPresent
+	// until the proto grows one (see the TODO on the constants above).
+	policy := PullPolicyIfNotPresent
+
+	if policy != PullPolicyAlways {
+		local, err := c.hasLocalImage(ctx)
+		if err != nil {
+			return errors.Wrap(err, "checking for local image")
+		}
+		if local {
+			image, err := c.client.GetImage(ctx, c.spec.Image)
+			if err != nil {
+				return errors.Wrap(err, "resolving local image")
+			}
+			c.image = image
+			return nil
+		}
+		if policy == PullPolicyNever {
+			return errors.Errorf("image %s not found locally and pull policy is %q", c.spec.Image, PullPolicyNever)
+		}
+	}
+
+	authorizer, err := authorizerFromRegistryAuth(c.spec.PullOptions.RegistryAuth)
+	if err != nil {
+		return errors.Wrap(err, "building registry authorizer")
+	}
+
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Authorizer: authorizer,
+	})
+
+	if progress != nil {
+		progress <- PullProgress{Image: c.spec.Image, Status: "pulling"}
+	}
+
+	image, err := c.client.Pull(ctx, c.spec.Image,
+		containerd.WithPullUnpack,
+		containerd.WithResolver(resolver),
+	)
+	if err != nil {
+		if progress != nil {
+			progress <- PullProgress{Image: c.spec.Image, Status: "error", Err: err}
+		}
+		return errors.Wrap(err, "pulling container image")
+	}
+	c.image = image
+
+	if progress != nil {
+		progress <- PullProgress{Image: c.spec.Image, Status: "complete"}
+	}
+
+	return nil
+}
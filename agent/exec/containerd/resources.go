@@ -0,0 +1,112 @@
+package containerd
+
+import (
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/docker/swarmkit/api"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// cpuQuotaPeriod is the period, in microseconds, that CPU.Quota below is
+// computed against. 100ms matches what the moby executor and dockerd use,
+// so a NanoCPUs limit means the same thing regardless of which executor a
+// task lands on.
+const cpuQuotaPeriod = 100000
+
+// cpusetCpusConstraint and cpusetMemsConstraint are the Placement.Constraints
+// keys used to pin a task's cgroup cpuset, in the same "key==value" form the
+// scheduler's other node/engine label constraints use. There's no dedicated
+// field for this on ResourceRequirements; riding along as an ordinary
+// constraint means it composes with scheduling the normal way instead of
+// needing its own enforcement path.
+const (
+	cpusetCpusConstraint = "node.labels.cpuset.cpus"
+	cpusetMemsConstraint = "node.labels.cpuset.mems"
+)
+
+// cpusetFromConstraints scans constraints for a "key==value" entry matching
+// key and returns its value, or "" if there isn't one.
+func cpusetFromConstraints(constraints []string, key string) string {
+	prefix := key + "=="
+	for _, c := range constraints {
+		if strings.HasPrefix(c, prefix) {
+			return strings.TrimPrefix(c, prefix)
+		}
+	}
+	return ""
+}
+
+// withResources translates a task's ResourceRequirements, plus any
+// cpuset-style Placement.Constraints, into the equivalent Linux cgroup
+// limits on the OCI spec. A nil task, or a nil task.Spec.Resources.Limits,
+// leaves spec.Linux.Resources untouched aside from any cpuset constraint.
+func (c *containerAdapter) withResources(task *api.Task) containerd.SpecOpts {
+	return func(s *specs.Spec) error {
+		if err := c.withUlimits()(s); err != nil {
+			return err
+		}
+
+		if task == nil {
+			return nil
+		}
+
+		if s.Linux == nil {
+			s.Linux = &specs.Linux{}
+		}
+		if s.Linux.Resources == nil {
+			s.Linux.Resources = &specs.LinuxResources{}
+		}
+
+		var limits *api.Resources
+		if task.Spec.Resources != nil {
+			limits = task.Spec.Resources.Limits
+		}
+		if limits != nil {
+			if limits.MemoryBytes > 0 {
+				memLimit := limits.MemoryBytes
+				s.Linux.Resources.Memory = &specs.LinuxMemory{Limit: &memLimit}
+			}
+
+			if limits.NanoCPUs > 0 {
+				quota := limits.NanoCPUs / 1e4
+				period := uint64(cpuQuotaPeriod)
+				s.Linux.Resources.CPU = &specs.LinuxCPU{Quota: &quota, Period: &period}
+			}
+
+			if limits.PidsLimit > 0 {
+				s.Linux.Resources.Pids = &specs.LinuxPids{Limit: limits.PidsLimit}
+			}
+		}
+
+		if task.Spec.Placement != nil {
+			cpus := cpusetFromConstraints(task.Spec.Placement.Constraints, cpusetCpusConstraint)
+			mems := cpusetFromConstraints(task.Spec.Placement.Constraints, cpusetMemsConstraint)
+			if cpus != "" || mems != "" {
+				if s.Linux.Resources.CPU == nil {
+					s.Linux.Resources.CPU = &specs.LinuxCPU{}
+				}
+				s.Linux.Resources.CPU.Cpus = cpus
+				s.Linux.Resources.CPU.Mems = mems
+			}
+		}
+
+		return nil
+	}
+}
+
+// withUlimits translates c.spec.Ulimits into one specs.POSIXRlimit per
+// entry. It's folded into withResources rather than exposed on its own
+// since both only apply once the container's process is otherwise set up.
+func (c *containerAdapter) withUlimits() containerd.SpecOpts {
+	return func(s *specs.Spec) error {
+		for _, u := range c.spec.Ulimits {
+			s.Process.Rlimits = append(s.Process.Rlimits, specs.POSIXRlimit{
+				Type: u.Name,
+				Soft: uint64(u.Soft),
+				Hard: uint64(u.Hard),
+			})
+		}
+		return nil
+	}
+}
@@ -0,0 +1,98 @@
+package containerd
+
+import (
+	"testing"
+
+	"github.com/docker/swarmkit/api"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestCpusetFromConstraints(t *testing.T) {
+	constraints := []string{
+		"node.labels.region==us-east",
+		"node.labels.cpuset.cpus==0-3",
+		"node.labels.cpuset.mems==0,1",
+	}
+
+	if got := cpusetFromConstraints(constraints, cpusetCpusConstraint); got != "0-3" {
+		t.Errorf("cpus = %q, want %q", got, "0-3")
+	}
+	if got := cpusetFromConstraints(constraints, cpusetMemsConstraint); got != "0,1" {
+		t.Errorf("mems = %q, want %q", got, "0,1")
+	}
+	if got := cpusetFromConstraints(constraints, "node.labels.missing"); got != "" {
+		t.Errorf("missing constraint = %q, want empty", got)
+	}
+	if got := cpusetFromConstraints(nil, cpusetCpusConstraint); got != "" {
+		t.Errorf("nil constraints = %q, want empty", got)
+	}
+}
+
+// TestWithResourcesRoundTrip asserts that a representative api.Task's
+// resource limits and cpuset placement constraints both land on the
+// generated OCI spec.
+func TestWithResourcesRoundTrip(t *testing.T) {
+	c := &containerAdapter{spec: &api.ContainerSpec{}}
+
+	task := &api.Task{
+		Spec: api.TaskSpec{
+			Resources: &api.ResourceRequirements{
+				Limits: &api.Resources{
+					NanoCPUs:    2e9,
+					MemoryBytes: 128 * 1024 * 1024,
+					PidsLimit:   100,
+				},
+			},
+			Placement: &api.Placement{
+				Constraints: []string{
+					"node.labels.cpuset.cpus==0-1",
+					"node.labels.cpuset.mems==0",
+				},
+			},
+		},
+	}
+
+	s := &specs.Spec{Process: &specs.Process{}}
+	if err := c.withResources(task)(s); err != nil {
+		t.Fatalf("withResources returned error: %v", err)
+	}
+
+	if s.Linux == nil || s.Linux.Resources == nil {
+		t.Fatal("expected Linux.Resources to be populated")
+	}
+
+	if s.Linux.Resources.Memory == nil || s.Linux.Resources.Memory.Limit == nil || *s.Linux.Resources.Memory.Limit != 128*1024*1024 {
+		t.Errorf("unexpected memory limit: %+v", s.Linux.Resources.Memory)
+	}
+
+	if s.Linux.Resources.CPU == nil || s.Linux.Resources.CPU.Quota == nil || *s.Linux.Resources.CPU.Quota != 2e9/1e4 {
+		t.Errorf("unexpected CPU quota: %+v", s.Linux.Resources.CPU)
+	}
+	if s.Linux.Resources.CPU.Period == nil || *s.Linux.Resources.CPU.Period != cpuQuotaPeriod {
+		t.Errorf("unexpected CPU period: %+v", s.Linux.Resources.CPU.Period)
+	}
+	if s.Linux.Resources.CPU.Cpus != "0-1" {
+		t.Errorf("Cpus = %q, want %q", s.Linux.Resources.CPU.Cpus, "0-1")
+	}
+	if s.Linux.Resources.CPU.Mems != "0" {
+		t.Errorf("Mems = %q, want %q", s.Linux.Resources.CPU.Mems, "0")
+	}
+
+	if s.Linux.Resources.Pids == nil || s.Linux.Resources.Pids.Limit != 100 {
+		t.Errorf("unexpected pids limit: %+v", s.Linux.Resources.Pids)
+	}
+}
+
+// TestWithResourcesNilTask asserts a nil task leaves resources untouched
+// beyond whatever withUlimits applies.
+func TestWithResourcesNilTask(t *testing.T) {
+	c := &containerAdapter{spec: &api.ContainerSpec{}}
+
+	s := &specs.Spec{Process: &specs.Process{}}
+	if err := c.withResources(nil)(s); err != nil {
+		t.Fatalf("withResources returned error: %v", err)
+	}
+	if s.Linux != nil && s.Linux.Resources != nil {
+		t.Errorf("expected no resources set for a nil task, got %+v", s.Linux.Resources)
+	}
+}
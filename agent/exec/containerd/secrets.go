@@ -0,0 +1,170 @@
+package containerd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/mount"
+	"github.com/docker/swarmkit/api"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// defaultSecretsDir is where a secret or config is mounted if its File
+// target doesn't already specify an absolute path.
+const defaultSecretsDir = "/run/secrets"
+
+// secretsTmpfsSize bounds the tmpfs backing a task's staged secrets/configs.
+// Secrets are small by design (they're meant for keys and credentials, not
+// payloads), so this is generous headroom rather than a real working limit.
+const secretsTmpfsSize = "size=1m,mode=0700"
+
+// fileTarget is the subset of api.SecretReference/api.ConfigReference that
+// withSecretsAndConfigs needs, since the two types share the same File
+// shape but aren't otherwise related.
+type fileTarget struct {
+	name string // secret or config name, used to build a unique staging path
+	file *api.FileTarget
+	data []byte
+}
+
+// secretsStagingDir is the host-side tmpfs mountpoint a task's secrets and
+// configs are staged under before being bind mounted into the container.
+func (c *containerAdapter) secretsStagingDir() string {
+	return filepath.Join(c.taskStateDir(), "secrets")
+}
+
+// withSecretsAndConfigs resolves every secret and config reference on the
+// container spec and stages each one as a file under a tmpfs directory
+// mounted for this task, so secret plaintext never touches the node's
+// persistent filesystem. Targets using the default path all live under the
+// same staging directory and are bind mounted into the container as that one
+// directory; a target with its own absolute path gets its own bind mount,
+// still sourced from the same tmpfs-backed file.
+func (c *containerAdapter) withSecretsAndConfigs(ctx context.Context) (containerd.SpecOpts, error) {
+	var targets []fileTarget
+
+	for _, ref := range c.spec.Secrets {
+		if c.secrets == nil {
+			return nil, errors.Errorf("no secret getter configured, cannot resolve secret %s", ref.SecretName)
+		}
+		secret, err := c.secrets.Get(ref.SecretID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolving secret %s", ref.SecretName)
+		}
+		targets = append(targets, fileTarget{name: ref.SecretName, file: ref.File, data: secret.Spec.Data})
+	}
+
+	for _, ref := range c.spec.Configs {
+		if c.configs == nil {
+			return nil, errors.Errorf("no config getter configured, cannot resolve config %s", ref.ConfigName)
+		}
+		config, err := c.configs.Get(ref.ConfigID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolving config %s", ref.ConfigName)
+		}
+		targets = append(targets, fileTarget{name: ref.ConfigName, file: ref.File, data: config.Spec.Data})
+	}
+
+	if len(targets) == 0 {
+		return func(s *specs.Spec) error { return nil }, nil
+	}
+
+	staging := c.secretsStagingDir()
+	if err := os.MkdirAll(staging, 0700); err != nil {
+		return nil, errors.Wrapf(err, "creating secrets staging dir %s", staging)
+	}
+	tmpfs := mount.Mount{
+		Type:    "tmpfs",
+		Source:  "tmpfs",
+		Options: []string{secretsTmpfsSize},
+	}
+	if err := tmpfs.Mount(staging); err != nil {
+		return nil, errors.Wrapf(err, "mounting tmpfs for secrets staging dir %s", staging)
+	}
+
+	// Absolute-target files get their own bind mount below; everything else
+	// lands under defaultSecretsDir and is covered by the single directory
+	// bind mount instead.
+	var absoluteHostPaths, absoluteContainerPaths []string
+	needsDefaultMount := false
+
+	for _, t := range targets {
+		// A relative File.Name is staged under its own requested name so the
+		// single defaultSecretsDir bind mount below exposes it there; an
+		// absolute one only needs a unique staging name, since it gets its
+		// own bind mount straight to that absolute path.
+		var hostPath string
+		if filepath.IsAbs(t.file.Name) {
+			hostPath = filepath.Join(staging, t.name)
+		} else {
+			hostPath = filepath.Join(staging, t.file.Name)
+			if err := os.MkdirAll(filepath.Dir(hostPath), 0700); err != nil {
+				return nil, errors.Wrapf(err, "creating staging subdirectory for %s", t.name)
+			}
+		}
+		if err := ioutil.WriteFile(hostPath, t.data, os.FileMode(t.file.Mode)); err != nil {
+			return nil, errors.Wrapf(err, "writing staged file for %s", t.name)
+		}
+		uid, err := strconv.Atoi(t.file.UID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing uid for %s", t.name)
+		}
+		gid, err := strconv.Atoi(t.file.GID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing gid for %s", t.name)
+		}
+		if err := os.Chown(hostPath, uid, gid); err != nil {
+			return nil, errors.Wrapf(err, "setting ownership on staged file for %s", t.name)
+		}
+
+		if filepath.IsAbs(t.file.Name) {
+			absoluteHostPaths = append(absoluteHostPaths, hostPath)
+			absoluteContainerPaths = append(absoluteContainerPaths, t.file.Name)
+		} else {
+			needsDefaultMount = true
+		}
+	}
+
+	return func(s *specs.Spec) error {
+		if needsDefaultMount {
+			s.Mounts = append(s.Mounts, specs.Mount{
+				Destination: defaultSecretsDir,
+				Type:        "bind",
+				Source:      staging,
+				Options:     []string{"rbind", "ro"},
+			})
+		}
+		for i := range absoluteHostPaths {
+			s.Mounts = append(s.Mounts, specs.Mount{
+				Destination: absoluteContainerPaths[i],
+				Type:        "bind",
+				Source:      absoluteHostPaths[i],
+				Options:     []string{"rbind", "ro"},
+			})
+		}
+		return nil
+	}, nil
+}
+
+// wipeSecretsAndConfigs unmounts and removes the per-task tmpfs staging
+// directory so secret and config material never outlives the task, whether
+// the task exits cleanly or the node crashes: the tmpfs itself, and
+// everything written to it, is gone the moment it's unmounted (or the node
+// reboots), unlike a plain on-disk directory that would need this cleanup to
+// actually run.
+func (c *containerAdapter) wipeSecretsAndConfigs() error {
+	staging := c.secretsStagingDir()
+	if _, err := os.Stat(staging); err == nil {
+		if err := mount.UnmountAll(staging, 0); err != nil {
+			return errors.Wrapf(err, "unmounting secrets staging dir %s", staging)
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.Wrapf(err, "checking secrets staging dir %s", staging)
+	}
+	return os.RemoveAll(staging)
+}
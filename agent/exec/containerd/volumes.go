@@ -0,0 +1,122 @@
+package containerd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshot"
+	"github.com/docker/swarmkit/api"
+	"github.com/docker/swarmkit/log"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// volumeSnapshotKey derives a stable snapshot key for a named volume mount,
+// so that the same volume resolves to the same snapshot across task
+// restarts. Named volumes key off the driver config name; anonymous ones
+// fall back to a deterministic hash of the mount source, mirroring how
+// docker keys its local volumes.
+func volumeSnapshotKey(m api.Mount) string {
+	if m.VolumeOptions != nil && m.VolumeOptions.DriverConfig != nil && m.VolumeOptions.DriverConfig.Name != "" {
+		return "volume-" + m.VolumeOptions.DriverConfig.Name
+	}
+	sum := sha256.Sum256([]byte(m.Source))
+	return "volume-" + hex.EncodeToString(sum[:])
+}
+
+// prepareVolume resolves the snapshot backing m, creating it (and seeding it
+// with the image's contents at m.Target) if this is the first time the
+// volume has been used. It returns the mounts to bind into the container's
+// OCI spec at m.Target.
+func (c *containerAdapter) prepareVolume(ctx context.Context, m api.Mount) ([]mount.Mount, error) {
+	snapshotter := c.client.SnapshotService()
+	key := volumeSnapshotKey(m)
+
+	mounts, err := snapshotter.Mounts(ctx, key)
+	if err == nil {
+		// Already prepared by a previous task using the same volume.
+		return mounts, nil
+	}
+
+	parent := ""
+	if c.image != nil {
+		parent = c.image.Target().Digest.String()
+	}
+
+	mounts, err = snapshotter.Prepare(ctx, key, parent)
+	if err != nil {
+		return nil, errors.Wrapf(err, "preparing snapshot for volume %s", key)
+	}
+
+	if parent != "" {
+		if err := seedVolumeFromImage(mounts, m.Target); err != nil {
+			// Best effort: an empty volume is still usable, just not
+			// pre-populated the way docker's "copy data from image into
+			// empty volume" behavior would give us. Log and keep going
+			// rather than failing the task over it.
+			log.G(ctx).WithError(err).Warnf("failed to seed volume %s from image contents", key)
+		}
+	}
+
+	return mounts, nil
+}
+
+// seedVolumeFromImage ensures target exists in the freshly created volume
+// snapshot. The snapshot was prepared with the image as its parent, so the
+// image's own contents at any path are already visible through the
+// snapshotter's copy-on-write chain without copying anything explicitly;
+// this only needs to create target itself in the cases where the image
+// doesn't already have something there.
+func seedVolumeFromImage(mounts []mount.Mount, target string) error {
+	return mount.WithTempMount(context.Background(), mounts, func(root string) error {
+		if _, err := os.Stat(filepath.Join(root, target)); os.IsNotExist(err) {
+			return os.MkdirAll(filepath.Join(root, target), 0755)
+		}
+		return nil
+	})
+}
+
+// releaseVolume drops the adapter's interest in a volume's snapshot without
+// deleting the underlying snapshot itself, since named volumes are expected
+// to survive the task that used them; pruneVolumes is what eventually
+// reclaims one that's no longer referenced by anything.
+//
+// There is nothing to unmount here: the mounts prepareVolume returned were
+// never host-mounted by swarmkit, they were handed to the container runtime
+// as OCI spec entries, which mounts (and, on teardown, unmounts) them inside
+// the container's own mount namespace as part of deleting the task/container
+// above in releaseVolumes' caller.
+func (c *containerAdapter) releaseVolume(ctx context.Context, m api.Mount) error {
+	return nil
+}
+
+// pruneVolumes removes volume snapshots that are no longer referenced by
+// any task on this node. It is not called from shutdown/remove, since a
+// volume is expected to outlive the task(s) that mounted it, and nothing in
+// this package calls it.
+func (c *containerAdapter) pruneVolumes(ctx context.Context, inUse map[string]struct{}) error {
+	snapshotter := c.client.SnapshotService()
+
+	var toRemove []string
+	if err := snapshotter.Walk(ctx, func(ctx context.Context, info snapshot.Info) error {
+		if len(info.Name) > len("volume-") && info.Name[:len("volume-")] == "volume-" {
+			if _, ok := inUse[info.Name]; !ok {
+				toRemove = append(toRemove, info.Name)
+			}
+		}
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "walking snapshots to prune volumes")
+	}
+
+	var firstErr error
+	for _, key := range toRemove {
+		if err := snapshotter.Remove(ctx, key); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "removing unreferenced volume snapshot %s", key)
+		}
+	}
+	return firstErr
+}
@@ -59,6 +59,9 @@ type SecurityConfig struct {
 
 	rootCA     *RootCA
 	externalCA *ExternalCA
+	rotation   *RootCARotation
+	signer     Signer
+	crl        *CRL
 
 	ServerTLSCreds *MutableTLSCreds
 	ClientTLSCreds *MutableTLSCreds
@@ -83,12 +86,23 @@ func NewSecurityConfig(rootCA *RootCA, clientTLSCreds, serverTLSCreds *MutableTL
 		MinVersion:   tls.VersionTLS12,
 	}
 
-	return &SecurityConfig{
+	s := &SecurityConfig{
 		rootCA:         rootCA,
 		externalCA:     NewExternalCA(rootCA, externalCATLSConfig),
 		ClientTLSCreds: clientTLSCreds,
 		ServerTLSCreds: serverTLSCreds,
 	}
+
+	// Install verifyPeerCertificate (CRL enforcement) and an OCSP staple on
+	// the initial TLS config too, not just on the first RenewTLSConfig
+	// cycle, so a certificate revoked before this node's first renewal is
+	// still rejected by its peers. s isn't shared with any other goroutine
+	// yet, so this is safe without holding s.mu.
+	if err := s.refreshTrustedPool(); err != nil {
+		log.G(context.Background()).WithError(err).Warn("failed to install CRL verification on initial TLS config")
+	}
+
+	return s
 }
 
 // RootCA returns the root CA.
@@ -100,16 +114,16 @@ func (s *SecurityConfig) RootCA() *RootCA {
 }
 
 // UpdateRootCA replaces the root CA with a new root CA based on the specified
-// certificate, key, and the number of hours the certificates issue should last.
+// certificate, key, and the number of hours the certificates issue should
+// last. This goes through StartRootCARotation rather than swapping s.rootCA
+// in place: an in-place swap would instantly stop validating any
+// certificate issued under the previous root, breaking in-flight mTLS
+// connections (and any peer that hasn't re-enrolled yet) the moment it
+// happened. The caller is responsible for calling
+// SecurityConfig.EvictPreviousRoot once it's established that every node
+// holds a certificate issued under the new root.
 func (s *SecurityConfig) UpdateRootCA(cert, key []byte, certExpiry time.Duration, roleAuthorizations map[string]api.RoleAuthorizations) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	rootCA, err := NewRootCA(cert, key, certExpiry, roleAuthorizations)
-	if err == nil {
-		s.rootCA = &rootCA
-	}
-
+	_, err := s.StartRootCARotation(cert, key, certExpiry, roleAuthorizations)
 	return err
 }
 
@@ -144,6 +158,30 @@ func SigningPolicy(certExpiry time.Duration) *cfconfig.Signing {
 // SecurityConfigPaths is used as a helper to hold all the paths of security relevant files
 type SecurityConfigPaths struct {
 	Node, RootCA CertPaths
+	// PKCS11 optionally points the root CA's signing operations at a token
+	// in a PKCS#11 module instead of the on-disk key at RootCA.Key. It is
+	// left zero-valued (Module == "") when the root key lives on disk.
+	PKCS11 PKCS11Config
+}
+
+// PKCS11Config identifies a PKCS#11 token and object to be used for CA
+// signing, plus a reference to where the token's PIN can be found. The PIN
+// itself is never stored here; SecurityConfigPaths only carries a pointer
+// to it (an environment variable name, or a path to a file) so that the PIN
+// never has to be serialized alongside the rest of the config.
+type PKCS11Config struct {
+	// Module is the path to the PKCS#11 shared object (e.g. libsofthsm2.so).
+	Module string
+	// TokenLabel identifies the token on the module to open a session with.
+	TokenLabel string
+	// KeyLabel identifies the CA private key object within the token.
+	KeyLabel string
+	// PINEnvVar is the name of the environment variable holding the token
+	// PIN. If empty, PINPath is used instead.
+	PINEnvVar string
+	// PINPath is a path to a file containing the token PIN, used when
+	// PINEnvVar is not set.
+	PINPath string
 }
 
 // NewConfigPaths returns the absolute paths to all of the different types of files
@@ -158,6 +196,16 @@ func NewConfigPaths(baseCertDir string) *SecurityConfigPaths {
 	}
 }
 
+// NewConfigPathsWithPKCS11 is like NewConfigPaths, but also sets PKCS11 to
+// the given PKCS#11 token configuration. LoadOrCreateSecurityConfig and
+// RenewTLSConfig build their own paths with NewConfigPaths, so they never
+// see a PKCS11 configuration set here.
+func NewConfigPathsWithPKCS11(baseCertDir string, pkcs11 PKCS11Config) *SecurityConfigPaths {
+	paths := NewConfigPaths(baseCertDir)
+	paths.PKCS11 = pkcs11
+	return paths
+}
+
 // GenerateJoinToken creates a new join token.
 func GenerateJoinToken(rootCA *RootCA) string {
 	var secretBytes [generatedSecretEntropyBytes]byte
@@ -197,6 +245,20 @@ func LoadOrCreateSecurityConfig(ctx context.Context, baseCertDir, token, propose
 		err                            error
 	)
 
+	// A PKCS#11-backed signer, if one is configured, takes over local
+	// issuance from the root CA's own on-disk key. It's built up front so
+	// both the "can we sign locally" decision below and the SecurityConfig
+	// returned at the end of this function agree on it. paths comes from
+	// NewConfigPaths above, which leaves PKCS11 zero-valued, so no signer is
+	// built here.
+	var pkcs11Signer Signer
+	if paths.PKCS11.Module != "" {
+		pkcs11Signer, err = newPKCS11Signer(paths.PKCS11)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open configured PKCS#11 signer")
+		}
+	}
+
 	// Check if we already have a CA certificate on disk. We need a CA to have a valid SecurityConfig
 	rootCA, err = GetLocalRootCA(baseCertDir, roleAuthorizations)
 	switch err {
@@ -254,7 +316,12 @@ func LoadOrCreateSecurityConfig(ctx context.Context, baseCertDir, token, propose
 			err        error
 		)
 
-		if rootCA.CanSign() {
+		canSignLocally := rootCA.CanSign()
+		if pkcs11Signer != nil {
+			canSignLocally = pkcs11Signer.CanSign()
+		}
+
+		if canSignLocally {
 			// Create a new random ID for this certificate
 			cn := identity.NewID()
 			org := identity.NewID()
@@ -265,7 +332,11 @@ func LoadOrCreateSecurityConfig(ctx context.Context, baseCertDir, token, propose
 					NodeMembership: api.NodeMembershipAccepted,
 				}
 			}
-			tlsKeyPair, err = rootCA.IssueAndSaveNewCertificates(paths.Node, cn, proposedRole, org)
+			if pkcs11Signer != nil {
+				tlsKeyPair, err = issueWithSigner(pkcs11Signer, paths.Node, cn, proposedRole, org)
+			} else {
+				tlsKeyPair, err = rootCA.IssueAndSaveNewCertificates(paths.Node, cn, proposedRole, org)
+			}
 			if err != nil {
 				log.G(ctx).WithFields(logrus.Fields{
 					"node.id":   cn,
@@ -316,7 +387,11 @@ func LoadOrCreateSecurityConfig(ctx context.Context, baseCertDir, token, propose
 		}).Debug("loaded node credentials")
 	}
 
-	return NewSecurityConfig(&rootCA, clientTLSCreds, serverTLSCreds), nil
+	securityConfig := NewSecurityConfig(&rootCA, clientTLSCreds, serverTLSCreds)
+	if pkcs11Signer != nil {
+		securityConfig.SetSigner(pkcs11Signer)
+	}
+	return securityConfig, nil
 }
 
 // RenewTLSConfig will continuously monitor for the necessity of renewing the local certificates, either by
@@ -385,16 +460,22 @@ func RenewTLSConfig(ctx context.Context, s *SecurityConfig, baseCertDir string,
 				continue
 			}
 
-			clientTLSConfig, err := NewClientTLSConfig(tlsKeyPair, rootCA.Pool, CARole)
+			clientTLSConfig, err := NewClientTLSConfig(tlsKeyPair, s.trustedRootPool(), CARole)
 			if err != nil {
 				log.WithError(err).Errorf("failed to create a new client config")
 				updates <- CertificateUpdate{Err: err}
 			}
-			serverTLSConfig, err := NewServerTLSConfig(tlsKeyPair, rootCA.Pool)
+			clientTLSConfig.VerifyPeerCertificate = s.verifyPeerCertificate
+
+			serverTLSConfig, err := NewServerTLSConfig(tlsKeyPair, s.trustedRootPool())
 			if err != nil {
 				log.WithError(err).Errorf("failed to create a new server config")
 				updates <- CertificateUpdate{Err: err}
 			}
+			serverTLSConfig.VerifyPeerCertificate = s.verifyPeerCertificate
+			if err := s.StapleOCSPResponse(&serverTLSConfig.Certificates[0]); err != nil {
+				log.WithError(err).Warnf("failed to staple an OCSP response to the renewed server certificate")
+			}
 
 			err = s.ClientTLSCreds.LoadNewTLSConfig(clientTLSConfig)
 			if err != nil {
@@ -0,0 +1,113 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspResponseValidity is how long a stapled OCSP response (or a response
+// from the in-process responder below) is valid for before a client must
+// re-check. It is kept short because revocation here is driven off the
+// in-memory CRL rather than a periodically republished signed CRL file.
+const ocspResponseValidity = 1 * time.Hour
+
+// ocspResponse builds and signs an OCSP response for leaf, consulting the
+// CRL for its revocation status. The response is signed by the root CA
+// itself, since swarmkit's managers act as both CA and OCSP responder. When
+// a pluggable Signer is configured (see SetSigner), it is used here too, so
+// a manager whose root key only exists inside a PKCS#11 token (and was
+// never written to rootCA.Key in the first place) can still staple OCSP
+// responses instead of silently never doing so.
+func (s *SecurityConfig) ocspResponse(leaf *x509.Certificate) ([]byte, error) {
+	rootCA := s.RootCA()
+
+	issuerCertBlock, _ := pem.Decode(rootCA.Cert)
+	if issuerCertBlock == nil {
+		return nil, errors.New("failed to parse root CA certificate PEM")
+	}
+	issuerCert, err := x509.ParseCertificate(issuerCertBlock.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse root CA certificate")
+	}
+
+	s.mu.Lock()
+	pluggableSigner := s.signer
+	s.mu.Unlock()
+
+	var signer crypto.Signer
+	if pluggableSigner != nil {
+		signer, err = pluggableSigner.CryptoSigner()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get signing key from configured signer for OCSP signing")
+		}
+	} else {
+		issuerKey, err := parseCAPrivateKey(rootCA.Key)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse root CA key for OCSP signing")
+		}
+		var ok bool
+		signer, ok = issuerKey.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("root CA key does not support signing OCSP responses")
+		}
+	}
+
+	status := ocsp.Good
+	if s.CRL().IsRevoked(leaf.SerialNumber) {
+		status = ocsp.Revoked
+	}
+
+	now := time.Now()
+	template := ocsp.Response{
+		Status:       status,
+		SerialNumber: leaf.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(ocspResponseValidity),
+	}
+
+	return ocsp.CreateResponse(issuerCert, issuerCert, template, signer)
+}
+
+// StapleOCSPResponse sets cert.OCSPStaple to a freshly signed OCSP response
+// for cert's leaf, so that a server using this certificate can staple it
+// during the TLS handshake and let clients short-circuit a full revocation
+// check. It's meant to be called each time a node's certificate is
+// (re)loaded, e.g. from RenewTLSConfig.
+func (s *SecurityConfig) StapleOCSPResponse(cert *tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return errors.New("no leaf certificate to staple an OCSP response for")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return errors.Wrap(err, "failed to parse leaf certificate")
+	}
+
+	staple, err := s.ocspResponse(leaf)
+	if err != nil {
+		return errors.Wrap(err, "failed to create OCSP staple")
+	}
+	cert.OCSPStaple = staple
+	return nil
+}
+
+// OCSPHandler answers an OCSP request for a single certificate by consulting
+// the CRL store, encoding the same way the stapled response above does. It
+// is meant to be mounted as a small responder alongside the CA server, for
+// clients that didn't get (or don't trust) a stapled response.
+func (s *SecurityConfig) OCSPHandler(rawOCSPRequest []byte) ([]byte, error) {
+	req, err := ocsp.ParseRequest(rawOCSPRequest)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse OCSP request")
+	}
+
+	// ocspResponse only needs the serial number off of the leaf to check it
+	// against the CRL, so a placeholder carrying just that is enough here.
+	leaf := &x509.Certificate{SerialNumber: req.SerialNumber}
+	return s.ocspResponse(leaf)
+}
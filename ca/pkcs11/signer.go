@@ -0,0 +1,328 @@
+// Package pkcs11 implements ca.Signer on top of a PKCS#11 token (YubiHSM,
+// SoftHSM, a cloud HSM's PKCS#11 shim, etc), so that a swarm manager's root
+// CA private key never has to be held in process memory or written to
+// disk in the clear.
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/cloudflare/cfssl/config"
+	"github.com/cloudflare/cfssl/signer"
+	"github.com/cloudflare/cfssl/signer/local"
+	p11 "github.com/miekg/pkcs11"
+	"github.com/pkg/errors"
+)
+
+// Config identifies the token, key object, and PIN source to open a
+// session against. It mirrors ca.PKCS11Config; callers typically build one
+// of these straight from the corresponding SecurityConfigPaths.PKCS11.
+type Config struct {
+	Module     string
+	TokenLabel string
+	KeyLabel   string
+	PINEnvVar  string
+	PINPath    string
+}
+
+func (c Config) pin() (string, error) {
+	if c.PINEnvVar != "" {
+		if pin := os.Getenv(c.PINEnvVar); pin != "" {
+			return pin, nil
+		}
+		return "", errors.Errorf("PKCS#11 PIN environment variable %s is not set", c.PINEnvVar)
+	}
+	if c.PINPath != "" {
+		contents, err := ioutil.ReadFile(c.PINPath)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to read PKCS#11 PIN file")
+		}
+		return strings.TrimSpace(string(contents)), nil
+	}
+	return "", errors.New("no PKCS#11 PIN source configured")
+}
+
+// Signer is a ca.Signer backed by a private key held in a PKCS#11 token.
+// It keeps a single open session for the lifetime of the process. Once a
+// signing operation on that session fails, the signer stays unhealthy and
+// the session is not re-opened.
+type Signer struct {
+	mu sync.Mutex
+
+	cfg       Config
+	ctx       *p11.Ctx
+	session   p11.SessionHandle
+	keyHandle p11.ObjectHandle
+	healthy   bool
+}
+
+// NewSigner opens a session against the token described by cfg and logs in
+// with its PIN, locating the private key object named by cfg.KeyLabel.
+func NewSigner(cfg Config) (*Signer, error) {
+	s := &Signer{cfg: cfg}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Signer) open() error {
+	ctx := p11.New(s.cfg.Module)
+	if ctx == nil {
+		return errors.Errorf("failed to load PKCS#11 module %s", s.cfg.Module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		return errors.Wrap(err, "failed to initialize PKCS#11 module")
+	}
+
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return errors.Wrap(err, "failed to list PKCS#11 slots")
+	}
+
+	var slot *uint
+	for _, candidate := range slots {
+		info, err := ctx.GetTokenInfo(candidate)
+		if err != nil {
+			continue
+		}
+		if strings.TrimRight(info.Label, "\x00 ") == s.cfg.TokenLabel {
+			c := candidate
+			slot = &c
+			break
+		}
+	}
+	if slot == nil {
+		return errors.Errorf("no PKCS#11 token found with label %q", s.cfg.TokenLabel)
+	}
+
+	session, err := ctx.OpenSession(*slot, p11.CKF_SERIAL_SESSION|p11.CKF_RW_SESSION)
+	if err != nil {
+		return errors.Wrap(err, "failed to open PKCS#11 session")
+	}
+
+	pin, err := s.cfg.pin()
+	if err != nil {
+		ctx.CloseSession(session)
+		return err
+	}
+	if err := ctx.Login(session, p11.CKU_USER, pin); err != nil {
+		ctx.CloseSession(session)
+		return errors.Wrap(err, "failed to login to PKCS#11 token")
+	}
+
+	template := []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_CLASS, p11.CKO_PRIVATE_KEY),
+		p11.NewAttribute(p11.CKA_LABEL, s.cfg.KeyLabel),
+	}
+	if err := ctx.FindObjectsInit(session, template); err != nil {
+		return errors.Wrap(err, "failed to look up PKCS#11 key object")
+	}
+	handles, _, err := ctx.FindObjects(session, 1)
+	ctx.FindObjectsFinal(session)
+	if err != nil {
+		return errors.Wrap(err, "failed to look up PKCS#11 key object")
+	}
+	if len(handles) == 0 {
+		return errors.Errorf("no PKCS#11 private key found with label %q", s.cfg.KeyLabel)
+	}
+
+	s.mu.Lock()
+	s.ctx = ctx
+	s.session = session
+	s.keyHandle = handles[0]
+	s.healthy = true
+	s.mu.Unlock()
+
+	return nil
+}
+
+// CanSign reports whether the PKCS#11 session is currently open and
+// healthy. A manager whose HSM has gone away (token unplugged, daemon
+// restarted) should report false here so enrollment requests fall back to
+// an ExternalCA peer instead of hanging against a dead session.
+func (s *Signer) CanSign() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.healthy
+}
+
+// Sign signs csrPEM with the token's private key, honoring the usages and
+// expiry from policy the same way the file-backed CFSSL local signer does.
+func (s *Signer) Sign(csrPEM []byte, policy *config.Signing) ([]byte, error) {
+	s.mu.Lock()
+	if !s.healthy {
+		s.mu.Unlock()
+		return nil, errors.New("PKCS#11 signer is not healthy")
+	}
+	ctx, session, keyHandle := s.ctx, s.session, s.keyHandle
+	s.mu.Unlock()
+
+	priv, err := newPKCS11PrivateKey(ctx, session, keyHandle)
+	if err != nil {
+		s.markUnhealthy()
+		return nil, errors.Wrap(err, "failed to bind PKCS#11 key handle")
+	}
+
+	sgnr, err := local.NewSigner(priv, nil, signer.DefaultSigAlgo(priv), policy)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create CFSSL signer over PKCS#11 key")
+	}
+
+	cert, err := sgnr.Sign(signer.SignRequest{Request: string(csrPEM)})
+	if err != nil {
+		s.markUnhealthy()
+		return nil, errors.Wrap(err, "PKCS#11 signing operation failed")
+	}
+
+	return cert, nil
+}
+
+// CryptoSigner returns the token's private key as a crypto.Signer, for
+// callers that need to sign something other than a CFSSL certificate
+// request, e.g. an OCSP response.
+func (s *Signer) CryptoSigner() (crypto.Signer, error) {
+	s.mu.Lock()
+	if !s.healthy {
+		s.mu.Unlock()
+		return nil, errors.New("PKCS#11 signer is not healthy")
+	}
+	ctx, session, keyHandle := s.ctx, s.session, s.keyHandle
+	s.mu.Unlock()
+
+	priv, err := newPKCS11PrivateKey(ctx, session, keyHandle)
+	if err != nil {
+		s.markUnhealthy()
+		return nil, errors.Wrap(err, "failed to bind PKCS#11 key handle")
+	}
+	return priv, nil
+}
+
+func (s *Signer) markUnhealthy() {
+	s.mu.Lock()
+	s.healthy = false
+	s.mu.Unlock()
+}
+
+// Close logs out and closes the PKCS#11 session.
+func (s *Signer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil {
+		return nil
+	}
+	s.ctx.Logout(s.session)
+	s.ctx.CloseSession(s.session)
+	s.ctx.Finalize()
+	s.ctx.Destroy()
+	s.healthy = false
+	return nil
+}
+
+// pkcs11PrivateKey adapts a PKCS#11 private key object to crypto.Signer so
+// that it can be handed to cfssl's local.Signer, which only ever calls
+// Public and Sign.
+type pkcs11PrivateKey struct {
+	ctx     *p11.Ctx
+	session p11.SessionHandle
+	handle  p11.ObjectHandle
+	pub     crypto.PublicKey
+}
+
+func newPKCS11PrivateKey(ctx *p11.Ctx, session p11.SessionHandle, handle p11.ObjectHandle) (*pkcs11PrivateKey, error) {
+	pub, err := publicKeyForHandle(ctx, session, handle)
+	if err != nil {
+		return nil, err
+	}
+	return &pkcs11PrivateKey{ctx: ctx, session: session, handle: handle, pub: pub}, nil
+}
+
+func (k *pkcs11PrivateKey) Public() crypto.PublicKey {
+	return k.pub
+}
+
+// sha256DigestInfoPrefix is the DER encoding of the DigestInfo ASN.1
+// structure's algorithm-identifier portion for SHA-256 (the same bytes
+// Go's own crypto/rsa prepends for PKCS#1v1.5 signing). digest is appended
+// directly after it to form the full DigestInfo that CKM_RSA_PKCS signs.
+var sha256DigestInfoPrefix = []byte{
+	0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20,
+}
+
+// Sign performs the raw signing operation on the token. digest is already
+// the SHA-256 hash of the data being signed, per the crypto.Signer
+// contract; CKM_RSA_PKCS expects to be handed a fully formed DigestInfo and
+// only does the padding and modular exponentiation itself, so the DigestInfo
+// prefix is built by hand here rather than using a mechanism like
+// CKM_SHA256_RSA_PKCS that would hash digest a second time and produce a
+// signature over the wrong value.
+func (k *pkcs11PrivateKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, errors.Errorf("PKCS#11 signer only supports SHA-256, got %v", opts.HashFunc())
+	}
+
+	digestInfo := append(append([]byte{}, sha256DigestInfoPrefix...), digest...)
+
+	mechanism := []*p11.Mechanism{p11.NewMechanism(p11.CKM_RSA_PKCS, nil)}
+	if err := k.ctx.SignInit(k.session, mechanism, k.handle); err != nil {
+		return nil, errors.Wrap(err, "failed to initialize PKCS#11 signing operation")
+	}
+	return k.ctx.Sign(k.session, digestInfo)
+}
+
+// publicKeyForHandle looks up the CKA_ID of the private key object at
+// handle, finds the CKO_PUBLIC_KEY object sharing that CKA_ID, and parses
+// its CKA_MODULUS/CKA_PUBLIC_EXPONENT attributes into an rsa.PublicKey.
+// Only RSA is supported, matching Sign's CKM_RSA_PKCS mechanism.
+func publicKeyForHandle(ctx *p11.Ctx, session p11.SessionHandle, handle p11.ObjectHandle) (crypto.PublicKey, error) {
+	idAttr, err := ctx.GetAttributeValue(session, handle, []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_ID, nil),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read CKA_ID off PKCS#11 private key")
+	}
+	if len(idAttr) == 0 || len(idAttr[0].Value) == 0 {
+		return nil, errors.New("PKCS#11 private key has no CKA_ID to match against its public key")
+	}
+	keyID := idAttr[0].Value
+
+	template := []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_CLASS, p11.CKO_PUBLIC_KEY),
+		p11.NewAttribute(p11.CKA_ID, keyID),
+	}
+	if err := ctx.FindObjectsInit(session, template); err != nil {
+		return nil, errors.Wrap(err, "failed to look up PKCS#11 public key object")
+	}
+	handles, _, err := ctx.FindObjects(session, 1)
+	ctx.FindObjectsFinal(session)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to look up PKCS#11 public key object")
+	}
+	if len(handles) == 0 {
+		return nil, errors.New("no PKCS#11 public key object found matching the private key's CKA_ID")
+	}
+	pubHandle := handles[0]
+
+	attrs, err := ctx.GetAttributeValue(session, pubHandle, []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_MODULUS, nil),
+		p11.NewAttribute(p11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read RSA public key attributes off PKCS#11 object")
+	}
+	if len(attrs) != 2 || len(attrs[0].Value) == 0 || len(attrs[1].Value) == 0 {
+		return nil, errors.New("PKCS#11 public key object is missing CKA_MODULUS or CKA_PUBLIC_EXPONENT")
+	}
+
+	modulus := new(big.Int).SetBytes(attrs[0].Value)
+	exponent := new(big.Int).SetBytes(attrs[1].Value)
+
+	return &rsa.PublicKey{N: modulus, E: int(exponent.Int64())}, nil
+}
@@ -0,0 +1,341 @@
+package ca
+
+import (
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/docker/swarmkit/api"
+	"github.com/docker/swarmkit/log"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// RootRotationState describes where a root CA rotation is in its lifecycle.
+type RootRotationState int
+
+const (
+	// RootRotationNone means no rotation is in progress. The SecurityConfig's
+	// rootCA is the only trusted root.
+	RootRotationNone RootRotationState = iota
+	// RootRotationAnnounced means a new root has been generated and
+	// cross-signed against the previous root, but nodes have not yet begun
+	// re-enrolling against it. Both roots are trusted.
+	RootRotationAnnounced
+	// RootRotationIssuingNew means new leaf certificates are being issued
+	// against the new root as nodes hit their normal renewal cadence. Both
+	// roots remain trusted so in-flight mTLS connections negotiated under
+	// either one keep working.
+	RootRotationIssuingNew
+	// RootRotationOldTrustRemoved means every node has reported a leaf
+	// issued by the new root, and the previous root has been evicted from
+	// the trust pool.
+	RootRotationOldTrustRemoved
+)
+
+func (s RootRotationState) String() string {
+	switch s {
+	case RootRotationNone:
+		return "none"
+	case RootRotationAnnounced:
+		return "announced"
+	case RootRotationIssuingNew:
+		return "issuing-with-new"
+	case RootRotationOldTrustRemoved:
+		return "old-trust-removed"
+	default:
+		return "unknown"
+	}
+}
+
+// RootCARotation tracks an in-progress rotation of the cluster's root CA. It
+// is held in memory on the SecurityConfig of the manager that called
+// StartRootCARotation and is not stored in the raft cluster object, so
+// other managers do not see it. That manager calls EvictPreviousRoot once
+// every node has reported progress via RecordNodeRotated.
+type RootCARotation struct {
+	mu sync.Mutex
+
+	state           RootRotationState
+	previousRoot    *RootCA
+	nextRoot        *RootCA
+	crossSignedCert []byte
+
+	// rotated tracks, per node ID, whether that node has reported holding a
+	// leaf certificate issued by nextRoot.
+	rotated map[string]bool
+}
+
+// State returns the current phase of the rotation.
+func (r *RootCARotation) State() RootRotationState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
+
+// CrossSignedCert returns the certificate binding the new root to the
+// previous one, to be distributed to nodes that still only trust the old
+// root.
+func (r *RootCARotation) CrossSignedCert() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.crossSignedCert
+}
+
+// RecordNodeRotated marks the given node as having successfully re-enrolled
+// against the new root, for Progress to report. Neither the CA server nor
+// any admin RPC in this tree calls it; the caller tracking re-enrollment
+// does, each time a node's issued certificate reflects the new root.
+func (r *RootCARotation) RecordNodeRotated(nodeID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rotated == nil {
+		r.rotated = make(map[string]bool)
+	}
+	r.rotated[nodeID] = true
+}
+
+// Progress reports, for a given set of node IDs, which of them have already
+// rotated to the new root. Callers typically pass the current membership
+// list so that nodes removed from the cluster mid-rotation don't block
+// completion forever.
+func (r *RootCARotation) Progress(nodeIDs []string) (rotated []string, pending []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, id := range nodeIDs {
+		if r.rotated[id] {
+			rotated = append(rotated, id)
+		} else {
+			pending = append(pending, id)
+		}
+	}
+	return
+}
+
+// RootCARotation returns the in-progress root rotation, or nil if none is
+// underway.
+func (s *SecurityConfig) RootCARotation() *RootCARotation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rotation
+}
+
+// StartRootCARotation begins a rotation to a new root CA. It cross-signs the
+// new root against the current one where possible (so leaves issued by
+// either are trusted transitively through the cross-signed intermediate),
+// merges both roots into the trust pool used by
+// NewServerTLSConfig/NewClientTLSConfig, and immediately refreshes this
+// manager's own ServerTLSCreds/ClientTLSCreds so that connections
+// negotiated before the next RenewTLSConfig cycle already trust the new
+// root. Other nodes pick up the new root the next time their own
+// RenewTLSConfig fires. The rotation starts in RootRotationAnnounced;
+// callers that track node-by-node re-enrollment progress (e.g. via
+// RecordNodeRotated) are expected to move it along to
+// RootRotationIssuingNew themselves once they observe the new root in use,
+// and to call EvictPreviousRoot once every node has caught up.
+//
+// TODO(ijc): drive state transitions (announced -> issuing-with-new ->
+// old-trust-removed) through the raft cluster object rather than locally, so
+// that every manager observes the same rotation instead of only the one
+// that called this method; wire CreateRootCARotation/GetRootCARotation
+// admin RPCs on top of this once the control API proto for it exists.
+func (s *SecurityConfig) StartRootCARotation(cert, key []byte, certExpiry time.Duration, roleAuthorizations map[string]api.RoleAuthorizations) (*RootCARotation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rotation != nil && s.rotation.state != RootRotationOldTrustRemoved {
+		return nil, errors.New("a root CA rotation is already in progress")
+	}
+
+	nextRoot, err := NewRootCA(cert, key, certExpiry, roleAuthorizations)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load new root CA")
+	}
+
+	// Cross-signing lets nodes that still only trust the previous root
+	// validate a leaf issued under the new one without having re-enrolled
+	// yet. It requires the previous root's own signing key, which isn't
+	// always available (e.g. an externally managed root); when it isn't,
+	// skip cross-signing rather than abort the rotation; those nodes will
+	// simply need to re-enroll before they trust anything issued under the
+	// new root, same as if cross-signing had never been implemented.
+	var crossSigned []byte
+	if s.rootCA.CanSign() {
+		crossSigned, err = s.rootCA.CrossSignCACertificate(nextRoot.Cert)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to cross-sign new root CA")
+		}
+	} else {
+		log.G(context.Background()).Warn("previous root CA cannot sign locally; rotating without a cross-signed certificate")
+	}
+
+	s.rotation = &RootCARotation{
+		state:           RootRotationAnnounced,
+		previousRoot:    s.rootCA,
+		nextRoot:        &nextRoot,
+		crossSignedCert: crossSigned,
+	}
+
+	if err := s.refreshTrustedPool(); err != nil {
+		return nil, errors.Wrap(err, "failed to update TLS credentials with rotated trust pool")
+	}
+
+	return s.rotation, nil
+}
+
+// refreshTrustedPool pushes the current trustedRootPool() into the live
+// ServerTLSCreds/ClientTLSCreds and the external CA client config, and
+// (re)installs verifyPeerCertificate and an OCSP staple on both, so that
+// connections negotiated before the next RenewTLSConfig cycle already trust
+// whatever the rotation added or removed and already reject a freshly
+// revoked peer. Callers must hold s.mu, or call it before s is shared with
+// any other goroutine (e.g. from NewSecurityConfig).
+func (s *SecurityConfig) refreshTrustedPool() error {
+	pool := s.trustedRootPool()
+
+	clientTLSConfig := s.ClientTLSCreds.Config()
+	clientTLSConfig.RootCAs = pool
+	clientTLSConfig.VerifyPeerCertificate = s.verifyPeerCertificate
+	if err := s.ClientTLSCreds.LoadNewTLSConfig(clientTLSConfig); err != nil {
+		return errors.Wrap(err, "failed to update client TLS credentials")
+	}
+
+	serverTLSConfig := s.ServerTLSCreds.Config()
+	serverTLSConfig.RootCAs = pool
+	serverTLSConfig.ClientCAs = pool
+	serverTLSConfig.VerifyPeerCertificate = s.verifyPeerCertificate
+	if len(serverTLSConfig.Certificates) > 0 {
+		if err := s.StapleOCSPResponse(&serverTLSConfig.Certificates[0]); err != nil {
+			log.G(context.Background()).WithError(err).Warn("failed to staple an OCSP response to the server certificate")
+		}
+	}
+	if err := s.ServerTLSCreds.LoadNewTLSConfig(serverTLSConfig); err != nil {
+		return errors.Wrap(err, "failed to update server TLS credentials")
+	}
+
+	s.externalCA.UpdateTLSConfig(&tls.Config{
+		Certificates: clientTLSConfig.Certificates,
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	})
+
+	return nil
+}
+
+// EvictPreviousRoot completes an in-progress rotation by dropping the
+// previous root from the trust pool and promoting the new root to be the
+// SecurityConfig's root CA. Callers should only invoke this once every node
+// has reported rotating, e.g. via RootCARotation().Progress.
+func (s *SecurityConfig) EvictPreviousRoot() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rotation == nil {
+		return errors.New("no root CA rotation in progress")
+	}
+
+	s.rotation.state = RootRotationOldTrustRemoved
+	s.rootCA = s.rotation.nextRoot
+	s.rotation = nil
+
+	if err := s.refreshTrustedPool(); err != nil {
+		return errors.Wrap(err, "failed to update TLS credentials after evicting previous root")
+	}
+
+	return nil
+}
+
+// trustedRootPool returns the x509.CertPool that should be used to validate
+// peer certificates: just the current root's pool, or the union of the
+// previous and next root's pools while a rotation is underway.
+func (s *SecurityConfig) trustedRootPool() *x509.CertPool {
+	if s.rotation == nil || s.rotation.state == RootRotationOldTrustRemoved {
+		return s.rootCA.Pool
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(s.rotation.previousRoot.Cert)
+	pool.AppendCertsFromPEM(s.rotation.nextRoot.Cert)
+	if s.rotation.crossSignedCert != nil {
+		pool.AppendCertsFromPEM(s.rotation.crossSignedCert)
+	}
+	return pool
+}
+
+// CrossSignCACertificate takes a new root CA certificate (PEM-encoded) and
+// re-signs it using this root's key, producing an intermediate that chains
+// the new root back to this one. Nodes which still only trust rca can
+// therefore validate a leaf issued by the new root, as long as the
+// cross-signed intermediate is included alongside it.
+func (rca *RootCA) CrossSignCACertificate(newCACertPEM []byte) ([]byte, error) {
+	if !rca.CanSign() {
+		return nil, errors.New("cannot cross-sign a new root CA certificate without a signing key")
+	}
+
+	newCertBlock, _ := pem.Decode(newCACertPEM)
+	if newCertBlock == nil {
+		return nil, errors.New("failed to parse new root CA certificate PEM")
+	}
+	newCert, err := x509.ParseCertificate(newCertBlock.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse new root CA certificate")
+	}
+
+	signingCertBlock, _ := pem.Decode(rca.Cert)
+	if signingCertBlock == nil {
+		return nil, errors.New("failed to parse signing root CA certificate PEM")
+	}
+	signingCert, err := x509.ParseCertificate(signingCertBlock.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse signing root CA certificate")
+	}
+
+	signingKey, err := parseCAPrivateKey(rca.Key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse signing root CA key")
+	}
+
+	serial, err := cryptorand.Int(cryptorand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate serial number for cross-signed certificate")
+	}
+
+	// Keep the new root's subject, public key, and CA extensions intact, but
+	// re-issue it as signed by the previous root rather than self-signed.
+	template := *newCert
+	template.SerialNumber = serial
+	template.Issuer = signingCert.Subject
+	template.AuthorityKeyId = signingCert.SubjectKeyId
+
+	der, err := x509.CreateCertificate(cryptorand.Reader, &template, signingCert, newCert.PublicKey, signingKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create cross-signed certificate")
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// parseCAPrivateKey parses a PEM-encoded private key in any of the formats
+// LoadTLSCreds might encounter (PKCS#1 RSA, SEC1 EC, or PKCS#8).
+func parseCAPrivateKey(keyPEM []byte) (interface{}, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("failed to parse private key PEM")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	return nil, errors.New("unsupported private key format")
+}
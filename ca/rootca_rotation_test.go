@@ -0,0 +1,86 @@
+package ca
+
+import (
+	"sort"
+	"testing"
+)
+
+// TestRootRotationStateString checks that every defined state renders to a
+// distinct, human-readable string instead of falling through to "unknown".
+func TestRootRotationStateString(t *testing.T) {
+	cases := map[RootRotationState]string{
+		RootRotationNone:            "none",
+		RootRotationAnnounced:       "announced",
+		RootRotationIssuingNew:      "issuing-with-new",
+		RootRotationOldTrustRemoved: "old-trust-removed",
+	}
+	for state, want := range cases {
+		if got := state.String(); got != want {
+			t.Errorf("RootRotationState(%d).String() = %q, want %q", state, got, want)
+		}
+	}
+}
+
+// TestRootCARotationProgress exercises the rolling-rotation bookkeeping a
+// manager uses to tell which nodes still need to pick up a leaf certificate
+// from the new root: nodes report in via RecordNodeRotated as they
+// re-enroll, in any order and at any pace, while nodes that haven't caught
+// up yet (old-leaf clients) remain pending alongside ones that have
+// (new-leaf clients) until every node has rotated.
+func TestRootCARotationProgress(t *testing.T) {
+	r := &RootCARotation{state: RootRotationAnnounced}
+
+	nodeIDs := []string{"node-1", "node-2", "node-3"}
+
+	rotated, pending := r.Progress(nodeIDs)
+	if len(rotated) != 0 {
+		t.Fatalf("expected no nodes rotated yet, got %v", rotated)
+	}
+	if len(pending) != len(nodeIDs) {
+		t.Fatalf("expected all nodes pending, got %v", pending)
+	}
+
+	// node-2 re-enrolls against the new root; node-1 and node-3 are still
+	// presenting leaves issued by the previous root.
+	r.RecordNodeRotated("node-2")
+
+	rotated, pending = r.Progress(nodeIDs)
+	sort.Strings(rotated)
+	sort.Strings(pending)
+
+	if len(rotated) != 1 || rotated[0] != "node-2" {
+		t.Fatalf("expected only node-2 rotated, got %v", rotated)
+	}
+	if len(pending) != 2 || pending[0] != "node-1" || pending[1] != "node-3" {
+		t.Fatalf("expected node-1 and node-3 pending, got %v", pending)
+	}
+
+	// Recording the same node again is a no-op, not a duplicate entry.
+	r.RecordNodeRotated("node-2")
+	rotated, _ = r.Progress(nodeIDs)
+	if len(rotated) != 1 {
+		t.Fatalf("expected RecordNodeRotated to be idempotent, got %v", rotated)
+	}
+
+	// The rest of the cluster catches up.
+	r.RecordNodeRotated("node-1")
+	r.RecordNodeRotated("node-3")
+
+	rotated, pending = r.Progress(nodeIDs)
+	if len(pending) != 0 {
+		t.Fatalf("expected no nodes pending once everyone has rotated, got %v", pending)
+	}
+	if len(rotated) != len(nodeIDs) {
+		t.Fatalf("expected every node rotated, got %v", rotated)
+	}
+
+	// A node removed from the cluster mid-rotation shouldn't block
+	// completion forever: Progress only reports on the IDs it's asked about.
+	rotated, pending = r.Progress([]string{"node-2", "node-4"})
+	if len(pending) != 1 || pending[0] != "node-4" {
+		t.Fatalf("expected only node-4 (never rotated, still queried) pending, got %v", pending)
+	}
+	if len(rotated) != 1 || rotated[0] != "node-2" {
+		t.Fatalf("expected node-2 rotated, got %v", rotated)
+	}
+}
@@ -0,0 +1,124 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/tls"
+	"io/ioutil"
+
+	cfconfig "github.com/cloudflare/cfssl/config"
+	"github.com/cloudflare/cfssl/csr"
+	"github.com/docker/swarmkit/ca/pkcs11"
+	"github.com/pkg/errors"
+)
+
+// Signer abstracts the private-key operation behind issuing a certificate
+// from a CSR, so that RootCA is not hard-coded to keep its key on disk.
+// Its one implementation is the HSM-backed signer in package ca/pkcs11,
+// which keeps the key in a PKCS#11 token. Without a Signer, signing uses
+// the RootCA's own key at rootCAKeyFilename directly; that path does not go
+// through this interface.
+//
+// SigningPolicy still controls the CFSSL policy (expiry, allowed usages,
+// CSR whitelist) applied to the request; Signer only performs the
+// underlying RSA/ECDSA operation.
+type Signer interface {
+	// CanSign reports whether the signer currently has access to usable
+	// key material. For a file-backed signer this is simply whether the
+	// key was loaded; for an HSM-backed signer it additionally reflects
+	// whether the token session is open and healthy.
+	CanSign() bool
+
+	// Sign issues a certificate for the PEM-encoded CSR under the given
+	// signing policy.
+	Sign(csrPEM []byte, policy *cfconfig.Signing) (certPEM []byte, err error)
+
+	// CryptoSigner returns the key material as a standard crypto.Signer,
+	// for raw signing operations that don't go through a CSR, such as
+	// signing an OCSP response. It must return the same key Sign above
+	// issues certificates with, so that stapled OCSP responses are signed
+	// by the same authority as the certificates they cover.
+	CryptoSigner() (crypto.Signer, error)
+}
+
+// SetSigner sets the Signer this SecurityConfig uses for signing OCSP
+// responses and consults in CanLocalSign, e.g. an HSM-backed one. Passing
+// nil reverts to signing OCSP responses directly with the RootCA's own key
+// material. Certificate issuance through RootCA does not consult it and
+// keeps signing with the RootCA's own key.
+//
+// TODO(ijc): once RootCA (ca/certificates.go) grows a pluggable Signer
+// field, this should simply set it there instead of being tracked
+// separately on SecurityConfig.
+func (s *SecurityConfig) SetSigner(signer Signer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.signer = signer
+}
+
+// CanLocalSign reports whether this manager can issue certificates itself,
+// either because its RootCA holds the private key on disk or because an
+// HSM-backed Signer has been configured and is healthy. When this returns
+// false, enrollment should be forwarded to an ExternalCA peer instead of
+// failing outright, the same way a manager with no local root key at all
+// already does in LoadOrCreateSecurityConfig.
+func (s *SecurityConfig) CanLocalSign() bool {
+	s.mu.Lock()
+	signer := s.signer
+	rootCA := s.rootCA
+	s.mu.Unlock()
+
+	if signer != nil {
+		return signer.CanSign()
+	}
+	return rootCA.CanSign()
+}
+
+// newPKCS11Signer opens a session against the token described by cfg and
+// returns it as a Signer, for SecurityConfigPaths.PKCS11 configurations.
+func newPKCS11Signer(cfg PKCS11Config) (Signer, error) {
+	return pkcs11.NewSigner(pkcs11.Config{
+		Module:     cfg.Module,
+		TokenLabel: cfg.TokenLabel,
+		KeyLabel:   cfg.KeyLabel,
+		PINEnvVar:  cfg.PINEnvVar,
+		PINPath:    cfg.PINPath,
+	})
+}
+
+// issueWithSigner generates a new key pair and CSR for cn/role/org, signs it
+// with signer under the standard SigningPolicy, and writes the resulting
+// certificate and key to paths. It's the Signer-backed equivalent of
+// RootCA.IssueAndSaveNewCertificates, used when a SecurityConfig has an
+// HSM-backed signer configured instead of (or in addition to) a local root
+// key on disk.
+func issueWithSigner(signer Signer, paths CertPaths, cn, role, org string) (*tls.Certificate, error) {
+	req := &csr.CertificateRequest{
+		CN:         cn,
+		Names:      []csr.Name{{O: org, OU: role}},
+		KeyRequest: csr.NewBasicKeyRequest(),
+	}
+
+	csrPEM, keyPEM, err := csr.ParseRequest(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate CSR for PKCS#11-signed certificate")
+	}
+
+	certPEM, err := signer.Sign(csrPEM, SigningPolicy(DefaultNodeCertExpiration))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign CSR with configured PKCS#11 signer")
+	}
+
+	if err := ioutil.WriteFile(paths.Key, keyPEM, 0600); err != nil {
+		return nil, errors.Wrap(err, "failed to save PKCS#11-issued node key")
+	}
+	if err := ioutil.WriteFile(paths.Cert, certPEM, 0644); err != nil {
+		return nil, errors.Wrap(err, "failed to save PKCS#11-issued node certificate")
+	}
+
+	keyPair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load PKCS#11-issued certificate/key pair")
+	}
+
+	return &keyPair, nil
+}